@@ -0,0 +1,40 @@
+package console
+
+import "io"
+
+// buffer is a growable byte slice used to accumulate a single log line
+// (or a handler's preformatted attribute context) before it is flushed.
+type buffer []byte
+
+func (b *buffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+func (b *buffer) WriteByte(c byte) error {
+	*b = append(*b, c)
+	return nil
+}
+
+func (b *buffer) WriteString(s string) (int, error) {
+	*b = append(*b, s...)
+	return len(s), nil
+}
+
+// copy appends the contents of src to b.
+func (b *buffer) copy(src *buffer) {
+	*b = append(*b, (*src)...)
+}
+
+// Reset truncates the buffer to zero length, keeping its backing array.
+func (b *buffer) Reset() {
+	*b = (*b)[:0]
+}
+
+// WriteTo implements io.WriterTo, writing the buffer's contents to w and
+// truncating the buffer to zero length afterwards.
+func (b *buffer) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(*b)
+	*b = (*b)[:0]
+	return int64(n), err
+}
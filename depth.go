@@ -0,0 +1,49 @@
+package console
+
+import "context"
+
+// depthContextKey is the unexported context.Context key PushDepth, PopDepth,
+// and Handler's indentation use to carry an indentation depth through a
+// context chain, so it tracks automatically instead of via a *DepthValuer
+// attribute passed to every log call.
+type depthContextKey struct{}
+
+// PushDepth returns a copy of ctx with its indentation depth incremented by
+// one. A Handler configured to indent (see HandlerOptions.Indent) reads this
+// depth from the context.Context given to Handle - i.e. from every
+// slog.InfoContext(ctx, ...) call (and equivalents) made with the returned
+// context, or any context derived from it - so nested calls indent further
+// without an explicit depth attribute on each one.
+//
+// Because context.Context is immutable, pushing never affects ctx itself or
+// any other context derived from it before the push; each goroutine's own
+// context chain tracks its own depth, which is naturally goroutine-safe.
+func PushDepth(ctx context.Context) context.Context {
+	depth, _ := depthFromContext(ctx)
+	return context.WithValue(ctx, depthContextKey{}, depth+1)
+}
+
+// PopDepth returns a copy of ctx with its indentation depth decremented by
+// one (floored at zero), the inverse of PushDepth.
+func PopDepth(ctx context.Context) context.Context {
+	depth, _ := depthFromContext(ctx)
+	if depth <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, depthContextKey{}, depth-1)
+}
+
+// Traced calls fn with ctx's indentation depth incremented by one, as
+// PushDepth would. Only the context fn receives (and any context derived
+// from it) sees the deeper indentation; ctx itself is unaffected, so the
+// increase is automatically undone once fn returns.
+func Traced(ctx context.Context, fn func(ctx context.Context)) {
+	fn(PushDepth(ctx))
+}
+
+// depthFromContext returns the indentation depth PushDepth has pushed onto
+// ctx, or (0, false) if ctx carries none.
+func depthFromContext(ctx context.Context) (int64, bool) {
+	depth, ok := ctx.Value(depthContextKey{}).(int64)
+	return depth, ok
+}
@@ -0,0 +1,284 @@
+package console
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format selects the output produced by a Handler.
+type Format int
+
+const (
+	// FormatConsole renders human-readable, optionally colorized console
+	// output. This is the default format.
+	FormatConsole Format = iota
+
+	// FormatJSON renders each record as a single line of JSON, with the
+	// same field names slog.JSONHandler uses ("time", "level", "msg",
+	// "source").
+	FormatJSON
+
+	// FormatLogfmt renders each record as a single line of logfmt-style
+	// key=value pairs, with the same field names slog.TextHandler uses.
+	FormatLogfmt
+)
+
+// encoder writes timestamp/level/source/message/attr fields into a buffer,
+// dispatching on HandlerOptions.Format. Color and theme are only applied
+// for FormatConsole; they're ignored for FormatJSON and FormatLogfmt.
+type encoder struct {
+	opts HandlerOptions
+}
+
+// writeRecordStart writes whatever preamble a format requires before its
+// first field (just "{" for JSON; nothing for console and logfmt).
+func (e *encoder) writeRecordStart(buf *buffer) {
+	if e.opts.Format == FormatJSON {
+		buf.WriteByte('{')
+	}
+}
+
+// writeSep writes whatever separator belongs before the next field, key,
+// or group: a comma for JSON, a space otherwise. Both are skipped when
+// buf is empty or, for JSON, when the last byte written was an opening
+// '{' — i.e. this is the first member of the current (possibly nested)
+// object, so no comma is needed.
+func (e *encoder) writeSep(buf *buffer) {
+	if n := len(*buf); n > 0 {
+		if e.opts.Format == FormatJSON {
+			if (*buf)[n-1] != '{' {
+				buf.WriteByte(',')
+			}
+			return
+		}
+		buf.WriteByte(' ')
+	}
+}
+
+// writeGroupOpen opens a nested JSON object for group name. It's a no-op
+// for console and logfmt, which render groups as dotted key prefixes
+// instead of nesting.
+func (e *encoder) writeGroupOpen(buf *buffer, name string) {
+	if e.opts.Format != FormatJSON {
+		return
+	}
+	e.writeSep(buf)
+	e.writeJSONString(buf, name)
+	buf.WriteByte(':')
+	buf.WriteByte('{')
+}
+
+// writeJSONString writes s as a properly escaped JSON string, including the
+// surrounding quotes. strconv.Quote produces Go syntax, not JSON (e.g. it
+// emits "\x01" for a control byte, which no JSON parser accepts), so this
+// goes through encoding/json instead; json.Marshal of a string never fails.
+func (e *encoder) writeJSONString(buf *buffer, s string) {
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+// writeGroupClose closes one JSON object opened by writeGroupOpen. It's a
+// no-op for console and logfmt.
+func (e *encoder) writeGroupClose(buf *buffer) {
+	if e.opts.Format == FormatJSON {
+		buf.WriteByte('}')
+	}
+}
+
+func (e *encoder) withColor(buf *buffer, code string, fn func()) {
+	if e.opts.Format != FormatConsole || e.opts.NoColor || code == "" {
+		fn()
+		return
+	}
+	buf.WriteString(code)
+	fn()
+	buf.WriteString(ansiReset)
+}
+
+// writeFieldKey writes the slog field name for one of the built-in
+// time/level/msg/source fields. Console format shows these fields as bare
+// colorized tokens, so it writes no key at all.
+func (e *encoder) writeFieldKey(buf *buffer, key string) {
+	switch e.opts.Format {
+	case FormatJSON:
+		e.writeJSONString(buf, key)
+		buf.WriteByte(':')
+	case FormatLogfmt:
+		buf.WriteString(key)
+		buf.WriteByte('=')
+	}
+}
+
+// writeAttrKey writes a user attribute's key. Unlike the built-in fields,
+// console format shows attribute keys too.
+func (e *encoder) writeAttrKey(buf *buffer, key string) {
+	switch e.opts.Format {
+	case FormatJSON:
+		e.writeJSONString(buf, key)
+		buf.WriteByte(':')
+	default:
+		buf.WriteString(key)
+		buf.WriteByte('=')
+	}
+}
+
+// writeTimestamp writes the record's time field. v is usually a KindTime
+// value, but may be anything ReplaceAttr chose to substitute.
+func (e *encoder) writeTimestamp(buf *buffer, v slog.Value) {
+	e.writeSep(buf)
+	e.writeFieldKey(buf, "time")
+	e.withColor(buf, e.opts.Theme.Timestamp(), func() {
+		if v.Kind() == slog.KindTime {
+			e.writeRaw(buf, v.Time().Format(e.opts.TimeFormat))
+			return
+		}
+		e.writeRaw(buf, v.String())
+	})
+}
+
+// writeLevel writes the record's level field. v.Any() is usually a
+// slog.Level, but may be anything ReplaceAttr chose to substitute.
+func (e *encoder) writeLevel(buf *buffer, v slog.Value) {
+	e.writeSep(buf)
+	e.writeFieldKey(buf, "level")
+	if level, ok := v.Any().(slog.Level); ok {
+		if e.opts.Format != FormatConsole {
+			// Theme (including any WithNamedLevel override) is a console-only
+			// concept; JSON and logfmt get slog's own level string, e.g.
+			// "INFO" or "INFO+2", regardless of Theme.
+			e.writeRaw(buf, level.String())
+			return
+		}
+		color, label := e.opts.Theme.Level(level)
+		e.withColor(buf, color, func() {
+			e.writeRaw(buf, label)
+		})
+		return
+	}
+	e.writeRaw(buf, v.String())
+}
+
+// writeSource writes the record's source field. v.Any() is usually a
+// *slog.Source, but may be anything ReplaceAttr chose to substitute.
+func (e *encoder) writeSource(buf *buffer, v slog.Value, cwd string) {
+	src, ok := v.Any().(*slog.Source)
+	if !ok {
+		e.writeSep(buf)
+		e.writeFieldKey(buf, "source")
+		e.withColor(buf, e.opts.Theme.Source(), func() {
+			e.writeRaw(buf, v.String())
+		})
+		return
+	}
+	if src.File == "" {
+		return
+	}
+	file := src.File
+	if rel, err := filepath.Rel(cwd, file); err == nil {
+		file = rel
+	}
+	e.writeSep(buf)
+	e.writeFieldKey(buf, "source")
+	e.withColor(buf, e.opts.Theme.Source(), func() {
+		e.writeRaw(buf, file+":"+strconv.Itoa(src.Line))
+	})
+}
+
+func (e *encoder) writeMessage(buf *buffer, v slog.Value) {
+	e.writeSep(buf)
+	e.writeFieldKey(buf, "msg")
+	e.withColor(buf, e.opts.Theme.Message(), func() {
+		e.writeString(buf, v.String())
+	})
+}
+
+// writeAttr writes a single leaf (non-group) attribute. groups is the
+// dotted prefix of any enclosing groups, already accumulated by the
+// caller. It's used to build a dotted key for console and logfmt; JSON
+// instead represents groups as nested objects (see writeGroupOpen), so
+// a.Key is written bare.
+func (e *encoder) writeAttr(buf *buffer, a slog.Attr, groups string) {
+	e.writeSep(buf)
+	key := a.Key
+	if e.opts.Format != FormatJSON && groups != "" {
+		key = groups + "." + a.Key
+	}
+	e.withColor(buf, e.opts.Theme.AttrKey(), func() {
+		e.writeAttrKey(buf, key)
+	})
+	e.withColor(buf, e.opts.Theme.AttrValue(), func() {
+		e.writeValue(buf, a.Value)
+	})
+}
+
+// writeRaw writes s verbatim for console and logfmt, or as a quoted JSON
+// string for FormatJSON. Used for the built-in fields (timestamp, level
+// label, source location), which console and logfmt write unquoted even
+// when they contain spaces (as the default time.DateTime timestamp does).
+func (e *encoder) writeRaw(buf *buffer, s string) {
+	if e.opts.Format == FormatJSON {
+		e.writeJSONString(buf, s)
+		return
+	}
+	buf.WriteString(s)
+}
+
+// writeString writes s as a bare token for console/logfmt (quoted with
+// strconv.Quote if s is empty or contains a space, tab, '"' or '='), or as
+// a quoted JSON string for FormatJSON.
+func (e *encoder) writeString(buf *buffer, s string) {
+	if e.opts.Format == FormatJSON {
+		e.writeJSONString(buf, s)
+		return
+	}
+	if s == "" || strings.ContainsAny(s, " \t\"=") {
+		buf.WriteString(strconv.Quote(s))
+		return
+	}
+	buf.WriteString(s)
+}
+
+func (e *encoder) writeValue(buf *buffer, v slog.Value) {
+	switch v.Kind() {
+	case slog.KindString:
+		e.writeString(buf, v.String())
+	case slog.KindInt64:
+		buf.WriteString(strconv.FormatInt(v.Int64(), 10))
+	case slog.KindUint64:
+		buf.WriteString(strconv.FormatUint(v.Uint64(), 10))
+	case slog.KindFloat64:
+		f := v.Float64()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			// JSON has no token for non-finite floats; render through
+			// writeString so FormatJSON gets a quoted string ("NaN",
+			// "+Inf", "-Inf") instead of a bare token no parser accepts.
+			e.writeString(buf, strconv.FormatFloat(f, 'g', -1, 64))
+			return
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	case slog.KindBool:
+		buf.WriteString(strconv.FormatBool(v.Bool()))
+	case slog.KindDuration:
+		e.writeString(buf, v.Duration().String())
+	case slog.KindTime:
+		e.writeString(buf, v.Time().Format(time.RFC3339))
+	default:
+		e.writeString(buf, v.String())
+	}
+}
+
+// NewLine terminates the record: closes the JSON object for FormatJSON,
+// otherwise just writes the line ending console output has always used.
+func (e *encoder) NewLine(buf *buffer) {
+	if e.opts.Format == FormatJSON {
+		buf.WriteByte('}')
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteString("\r\n")
+}
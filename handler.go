@@ -5,6 +5,7 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -36,11 +37,42 @@ type HandlerOptions struct {
 	// TimeFormat is the format used for time.DateTime
 	TimeFormat string
 
-	// Theme defines the colorized output using ANSI escape sequences
+	// Theme defines the colorized output using ANSI escape sequences.
+	// Ignored unless Format is FormatConsole.
 	Theme Theme
 
 	// Indent defines a way for the message and attributes to be indented.
+	// Only applies to FormatConsole; JSON and logfmt records are never indented.
 	Indent Indentation
+
+	// Format selects the output produced by the Handler: console (the
+	// default), JSON, or logfmt. NoColor, Theme, and Indent only affect
+	// FormatConsole output.
+	Format Format
+
+	// ReplaceAttr is called to rewrite each attribute before it is logged,
+	// with the same semantics as slog.HandlerOptions.ReplaceAttr: it is
+	// called for the built-in time/level/source/msg attributes (each with
+	// an empty groups slice) as well as for every other non-group
+	// attribute (with groups set to the names of the enclosing groups,
+	// outermost first). The returned Attr is logged in place of a, unless
+	// its Key is empty, in which case the attribute is omitted entirely.
+	// If ReplaceAttr is nil, attributes are logged unchanged.
+	ReplaceAttr func(groups []string, a slog.Attr) slog.Attr
+
+	// Vmodule overrides Level on a per-file or per-package basis, using
+	// the same syntax as go-ethereum's GlogHandler: a comma-separated list
+	// of "pattern=level" entries, e.g. "server/*=debug,db/query.go=trace".
+	// A pattern ending in "/*" matches every file in that package
+	// directory; any other pattern matches a single file by name. Entries
+	// are tried in order and the first match wins; a record whose source
+	// file matches no entry falls back to Level. Level names are "trace",
+	// "debug", "info", "warn", and "error" (case-insensitive).
+	//
+	// Vmodule only takes effect for records that carry a PC (i.e. AddSource
+	// is usable), since the source file isn't known any earlier. Use
+	// SetVmodule to change these rules after the Handler is built.
+	Vmodule string
 }
 
 const defaultIndentKey = "depth"
@@ -100,9 +132,29 @@ func (indent *Indentation) isZero() bool {
 }
 
 type Handler struct {
-	opts    HandlerOptions
-	out     io.Writer
-	group   string
+	opts   HandlerOptions
+	out    io.Writer
+	mu     *sync.Mutex // shared across all derivatives of the same root Handler
+	group  string      // dotted group prefix, used to key-prefix console/logfmt attrs
+	groups []string    // full group stack, passed to ReplaceAttr
+
+	// unopenedGroups are the trailing entries of groups (for FormatJSON
+	// only) that have been added by WithGroup but have no attribute
+	// written under them yet, so their JSON object hasn't been opened in
+	// context. They're opened lazily, on the first attribute actually
+	// written within them, so that a group with no attributes at all
+	// never appears in the output.
+	unopenedGroups []string
+
+	// openGroupCount is how many JSON objects are already open (and
+	// deliberately left unclosed) at the end of context, so that a later
+	// WithAttrs or Handle call can keep appending into the same groups.
+	// Handle closes all of them, plus any it opens itself, before the
+	// record's closing brace.
+	openGroupCount int
+
+	vmodule *vmoduleState // shared across all derivatives of the same root Handler
+
 	context buffer
 	enc     *encoder
 }
@@ -129,64 +181,227 @@ func NewHandler(out io.Writer, opts *HandlerOptions) *Handler {
 		opts.Indent.Key = defaultIndentKey
 	}
 	return &Handler{
-		opts:    *opts, // Copy struct
-		out:     out,
-		group:   "",
-		context: nil,
-		enc:     &encoder{opts: *opts},
+		opts:           *opts, // Copy struct
+		out:            out,
+		mu:             new(sync.Mutex),
+		group:          "",
+		groups:         nil,
+		unopenedGroups: nil,
+		openGroupCount: 0,
+		vmodule:        newVmoduleState(opts.Vmodule),
+		context:        nil,
+		enc:            &encoder{opts: *opts},
 	}
 }
 
 // / Enabled implements slog.Handler.
+//
+// Vmodule rules are resolved per source file, which Enabled can't know (it
+// isn't given the record's PC), so Enabled only rules out a level too low
+// for Level and every Vmodule rule to possibly allow; Handle makes the
+// precise, per-file decision once it has the record.
 func (h *Handler) Enabled(_ context.Context, l slog.Level) bool {
-	return l >= h.opts.Level.Level()
+	return l >= h.vmodule.minLevel(h.opts.Level.Level())
+}
+
+// SetVmodule reconfigures per-file or per-package level filtering, using
+// the same syntax as HandlerOptions.Vmodule, replacing any rules set there
+// or by a previous SetVmodule call. Since the rules are shared with every
+// Handler derived from the same root (e.g. via WithAttrs or WithGroup),
+// this affects all of them at once, the same way mutating a shared
+// slog.LevelVar does.
+func (h *Handler) SetVmodule(v string) {
+	h.vmodule.set(v)
+}
+
+// replaceBuiltin runs a through ReplaceAttr (if set), using an empty groups
+// slice as required for the built-in time/level/source/msg attributes. It
+// reports false if the attribute should be omitted entirely.
+func (h *Handler) replaceBuiltin(a slog.Attr) (slog.Attr, bool) {
+	if h.opts.ReplaceAttr == nil {
+		return a, true
+	}
+	a = h.opts.ReplaceAttr(nil, a)
+	return a, a.Key != ""
+}
+
+// writeAttr recursively flattens a's groups, running every non-group
+// attribute through ReplaceAttr with the correct groups stack, then hands
+// the surviving leaf attributes to the encoder. groupPrefix is the dotted
+// key prefix (e.g. "a.b") and groups is the same prefix as a slice (e.g.
+// ["a", "b"]), as required by the ReplaceAttr signature.
+//
+// onLeaf, if non-nil, is called exactly once, just before the first leaf
+// attribute actually reaches the encoder. Handle uses it to lazily open
+// any pending WithGroup groups only once a record turns out to have a
+// surviving attribute to put in them; once called, onLeaf is cleared so
+// inline slog.Group attrs that open their own JSON object don't call it
+// again.
+func (h *Handler) writeAttr(buf *buffer, a slog.Attr, groupPrefix string, groups []string, onLeaf *func()) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		if len(attrs) == 0 {
+			return
+		}
+		prefix := a.Key
+		if groupPrefix != "" {
+			prefix = groupPrefix + "." + a.Key
+		}
+		nested := append(append([]string{}, groups...), a.Key)
+		if h.opts.Format == FormatJSON {
+			// Inline groups nest as their own self-contained JSON object,
+			// but (like unopenedGroups) must vanish entirely if every
+			// child is later dropped by ReplaceAttr. So defer opening
+			// this group, the same way Handle defers h.unopenedGroups,
+			// until a leaf attribute of it actually survives.
+			opened := false
+			var openThis func()
+			openThis = func() {
+				opened = true
+				if onLeaf != nil && *onLeaf != nil {
+					(*onLeaf)()
+					*onLeaf = nil
+				}
+				h.enc.writeGroupOpen(buf, a.Key)
+			}
+			childLeaf := openThis
+			for _, ga := range attrs {
+				h.writeAttr(buf, ga, prefix, nested, &childLeaf)
+			}
+			if opened {
+				h.enc.writeGroupClose(buf)
+			}
+			return
+		}
+		for _, ga := range attrs {
+			h.writeAttr(buf, ga, prefix, nested, onLeaf)
+		}
+		return
+	}
+	if h.opts.ReplaceAttr != nil {
+		a = h.opts.ReplaceAttr(groups, a)
+		a.Value = a.Value.Resolve()
+	}
+	if a.Key == "" || a.Equal(slog.Attr{}) {
+		return
+	}
+	if onLeaf != nil && *onLeaf != nil {
+		(*onLeaf)()
+		*onLeaf = nil
+	}
+	h.enc.writeAttr(buf, a, groupPrefix)
 }
 
 // Handle implements slog.Handler.
-func (h *Handler) Handle(_ context.Context, rec slog.Record) error {
+func (h *Handler) Handle(ctx context.Context, rec slog.Record) error {
+	effLevel := h.opts.Level.Level()
+	if rec.PC > 0 {
+		effLevel = h.vmodule.effectiveLevel(rec.PC, effLevel)
+	}
+	if rec.Level < effLevel {
+		return nil
+	}
+
 	buf := bufferPool.Get().(*buffer)
 
-	h.enc.writeTimestamp(buf, rec.Time)
-	h.enc.writeLevel(buf, rec.Level)
+	h.enc.writeRecordStart(buf)
+	if !rec.Time.IsZero() {
+		if a, ok := h.replaceBuiltin(slog.Time(slog.TimeKey, rec.Time)); ok {
+			h.enc.writeTimestamp(buf, a.Value)
+		}
+	}
+	if a, ok := h.replaceBuiltin(slog.Any(slog.LevelKey, rec.Level)); ok {
+		h.enc.writeLevel(buf, a.Value)
+	}
 	if h.opts.AddSource && rec.PC > 0 {
-		h.enc.writeSource(buf, rec.PC, cwd)
+		if a, ok := h.replaceBuiltin(slog.Any(slog.SourceKey, sourceForPC(rec.PC))); ok {
+			h.enc.writeSource(buf, a.Value, cwd)
+		}
 	}
-	if h.opts.Indent.isZero() {
-		h.enc.writeMessage(buf, rec.Level, rec.Message)
-		buf.copy(&h.context)
-		rec.Attrs(func(a slog.Attr) bool {
-			h.enc.writeAttr(buf, a, h.group)
-			return true
-		})
-	} else {
-		// NewHandler() should always set h.opts.IndentKey to a non-empty value.
-		key := h.opts.Indent.Key
-		// Indent the message and attributes.
-		// Can't just ask for the depth key, must iterate through attributes.
+
+	// opened lazily opens h.unopenedGroups in buf the first time a
+	// surviving leaf attribute is actually written for this record, so a
+	// WithGroup with no attributes in the end never appears in the output.
+	opened := false
+	var ensureOpen func()
+	ensureOpen = func() {
+		opened = true
+		for _, g := range h.unopenedGroups {
+			h.enc.writeGroupOpen(buf, g)
+		}
+	}
+	onLeaf := ensureOpen
+
+	msg := rec.Message
+	if h.opts.Format == FormatConsole && !h.opts.Indent.isZero() {
 		var attributes []slog.Attr
 		var depth int64
-		rec.Attrs(func(a slog.Attr) bool {
-			if a.Key == key {
-				value := a.Value
-				if value.Kind() == slog.KindLogValuer {
-					value = a.Value.LogValuer().LogValue()
-				}
-				if value.Kind() == slog.KindInt64 {
-					depth = value.Int64()
-				}
-			} else {
+		if ctxDepth, ok := depthFromContext(ctx); ok {
+			// ctx carries a depth pushed by PushDepth/Traced: use it
+			// directly, and every attribute is a real attribute (there's
+			// no magic depth key to filter out of the record).
+			depth = ctxDepth
+			rec.Attrs(func(a slog.Attr) bool {
 				attributes = append(attributes, a)
-			}
-			return true
-		})
-		h.enc.writeMessage(buf, rec.Level, h.opts.Indent.indentString(depth)+rec.Message)
+				return true
+			})
+		} else {
+			// NewHandler() should always set h.opts.IndentKey to a non-empty value.
+			key := h.opts.Indent.Key
+			// Indent the message and attributes.
+			// Can't just ask for the depth key, must iterate through attributes.
+			rec.Attrs(func(a slog.Attr) bool {
+				if a.Key == key {
+					value := a.Value
+					if value.Kind() == slog.KindLogValuer {
+						value = a.Value.LogValuer().LogValue()
+					}
+					if value.Kind() == slog.KindInt64 {
+						depth = value.Int64()
+					}
+				} else {
+					attributes = append(attributes, a)
+				}
+				return true
+			})
+		}
+		msg = h.opts.Indent.indentString(depth) + msg
+		if a, ok := h.replaceBuiltin(slog.String(slog.MessageKey, msg)); ok {
+			h.enc.writeMessage(buf, a.Value)
+		}
+		if len(h.context) > 0 {
+			h.enc.writeSep(buf)
+		}
 		buf.copy(&h.context)
 		for _, a := range attributes {
-			h.enc.writeAttr(buf, a, h.group)
+			h.writeAttr(buf, a, h.group, h.groups, &onLeaf)
+		}
+	} else {
+		if a, ok := h.replaceBuiltin(slog.String(slog.MessageKey, msg)); ok {
+			h.enc.writeMessage(buf, a.Value)
 		}
+		if len(h.context) > 0 {
+			h.enc.writeSep(buf)
+		}
+		buf.copy(&h.context)
+		rec.Attrs(func(a slog.Attr) bool {
+			h.writeAttr(buf, a, h.group, h.groups, &onLeaf)
+			return true
+		})
+	}
+	closeCount := h.openGroupCount
+	if opened {
+		closeCount += len(h.unopenedGroups)
+	}
+	for i := 0; i < closeCount; i++ {
+		h.enc.writeGroupClose(buf)
 	}
 	h.enc.NewLine(buf)
-	if _, err := buf.WriteTo(h.out); err != nil {
+	h.mu.Lock()
+	_, err := buf.WriteTo(h.out)
+	h.mu.Unlock()
+	if err != nil {
 		buf.Reset()
 		bufferPool.Put(buf)
 		return err
@@ -197,32 +412,82 @@ func (h *Handler) Handle(_ context.Context, rec slog.Record) error {
 
 // WithAttrs implements slog.Handler.
 func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	newCtx := h.context
+	if len(attrs) == 0 {
+		return h
+	}
+	// Copy h.context into a new buffer with no spare capacity, rather than
+	// just slicing it, so that writeAttr's appends below can never write
+	// into memory shared with h.context (or with some other derivative of
+	// h built concurrently from the same parent).
+	newCtx := make(buffer, len(h.context))
+	copy(newCtx, h.context)
+	// opened lazily opens h.unopenedGroups in newCtx the first time a
+	// surviving leaf attribute is actually written, so a WithGroup with
+	// no surviving attributes in the end never appears in the output.
+	opened := false
+	var ensureOpen func()
+	ensureOpen = func() {
+		opened = true
+		for _, g := range h.unopenedGroups {
+			h.enc.writeGroupOpen(&newCtx, g)
+		}
+	}
+	onLeaf := ensureOpen
 	for _, a := range attrs {
-		h.enc.writeAttr(&newCtx, a, h.group)
+		h.writeAttr(&newCtx, a, h.group, h.groups, &onLeaf)
+	}
+	unopenedGroups := h.unopenedGroups
+	openCount := h.openGroupCount
+	if opened {
+		unopenedGroups = nil
+		openCount += len(h.unopenedGroups)
 	}
-	newCtx.Clip()
 	return &Handler{
-		opts:    h.opts,
-		out:     h.out,
-		group:   h.group,
-		context: newCtx,
-		enc:     h.enc,
+		opts:           h.opts,
+		out:            h.out,
+		mu:             h.mu,
+		group:          h.group,
+		groups:         h.groups,
+		unopenedGroups: unopenedGroups,
+		openGroupCount: openCount,
+		vmodule:        h.vmodule,
+		context:        newCtx,
+		enc:            h.enc,
 	}
 }
 
 // WithGroup implements slog.Handler.
 func (h *Handler) WithGroup(name string) slog.Handler {
 	name = strings.TrimSpace(name)
+	groups := append(append([]string{}, h.groups...), name)
+	group := name
 	if h.group != "" {
-		name = h.group + "." + name
+		group = h.group + "." + name
 	}
+	unopenedGroups := append(append([]string{}, h.unopenedGroups...), name)
 	return &Handler{
-		opts:    h.opts,
-		out:     h.out,
-		group:   name,
-		context: h.context,
-		enc:     h.enc,
+		opts:           h.opts,
+		out:            h.out,
+		mu:             h.mu,
+		group:          group,
+		groups:         groups,
+		unopenedGroups: unopenedGroups,
+		openGroupCount: h.openGroupCount,
+		vmodule:        h.vmodule,
+		context:        h.context,
+		enc:            h.enc,
+	}
+}
+
+// sourceForPC resolves pc to a *slog.Source, the same way slog's built-in
+// handlers do, so it can be passed through ReplaceAttr like the standard
+// library's source attribute.
+func sourceForPC(pc uintptr) *slog.Source {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	return &slog.Source{
+		Function: frame.Function,
+		File:     frame.File,
+		Line:     frame.Line,
 	}
 }
 
@@ -231,6 +496,10 @@ func (h *Handler) WithGroup(name string) slog.Handler {
 // Use a pointer to a DepthValuer object in logging statements, do not pass the object itself.
 // This object is not thread safe. Using it as a global variable (the mostly likely usage)
 // in a multithreaded application will result in unpredictable values in different threads.
+//
+// PushDepth, PopDepth, and Traced track depth through a context.Context
+// instead, which is naturally goroutine-safe since each goroutine derives
+// its own context chain; prefer them over DepthValuer in new code.
 type DepthValuer struct {
 	depth int
 }
@@ -3,12 +3,24 @@ package console
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"math"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
 
+// recordAt builds a slog.Record for msg at level whose PC resolves to this
+// file, so Vmodule rules naming "handler_test.go" match it.
+func recordAt(level slog.Level, msg string) slog.Record {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	return slog.NewRecord(time.Now(), level, msg, pcs[0])
+}
+
 func TestHandler_colors(t *testing.T) {
 	buf := bytes.Buffer{}
 	h := NewHandler(&buf, nil)
@@ -77,6 +89,259 @@ func TestHandler_WithAttr(t *testing.T) {
 	AssertEqual(t, fmt.Sprintf("%s INF foobar\r\n", now.Format(time.DateTime)), buf.String())
 }
 
+func TestHandler_FormatJSON(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := NewHandler(&buf, &HandlerOptions{Format: FormatJSON})
+	now := time.Now()
+	rec := slog.NewRecord(now, slog.LevelInfo, "foobar", 0)
+	rec.AddAttrs(slog.String("foo", "bar"))
+	AssertNoError(t, h.Handle(context.Background(), rec))
+
+	expected := fmt.Sprintf(`{"time":"%s","level":"INFO","msg":"foobar","foo":"bar"}`+"\n", now.Format(time.DateTime))
+	AssertEqual(t, expected, buf.String())
+}
+
+func TestHandler_FormatJSON_ValidJSON(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := NewHandler(&buf, &HandlerOptions{Format: FormatJSON})
+	now := time.Now()
+
+	// A control byte and a non-finite float must still round-trip through
+	// a real JSON decoder, not just look plausible.
+	rec := slog.NewRecord(now, slog.LevelInfo, "foobar", 0)
+	rec.AddAttrs(
+		slog.String("ctrl", "a\x01b"),
+		slog.Float64("nan", math.NaN()),
+		slog.Float64("inf", math.Inf(1)),
+	)
+	AssertNoError(t, h.Handle(context.Background(), rec))
+
+	var decoded map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("handler output is not valid JSON: %v (output: %s)", err, buf.String())
+	}
+	AssertEqual(t, "a\x01b", decoded["ctrl"])
+	AssertEqual(t, "NaN", decoded["nan"])
+	AssertEqual(t, "+Inf", decoded["inf"])
+}
+
+func TestHandler_FormatLogfmt(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := NewHandler(&buf, &HandlerOptions{Format: FormatLogfmt})
+	now := time.Now()
+	rec := slog.NewRecord(now, slog.LevelInfo, "foobar", 0)
+	rec.AddAttrs(slog.String("foo", "bar"))
+	AssertNoError(t, h.Handle(context.Background(), rec))
+
+	expected := fmt.Sprintf("time=%s level=INFO msg=foobar foo=bar\r\n", now.Format(time.DateTime))
+	AssertEqual(t, expected, buf.String())
+}
+
+func TestHandler_ReplaceAttr(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := NewHandler(&buf, &HandlerOptions{
+		NoColor: true,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == "secret" {
+				return slog.String(a.Key, "REDACTED")
+			}
+			if a.Key == "drop" {
+				return slog.Attr{}
+			}
+			if a.Key == slog.MessageKey {
+				return slog.String(a.Key, "["+a.Value.String()+"]")
+			}
+			return a
+		},
+	})
+	now := time.Now()
+	rec := slog.NewRecord(now, slog.LevelInfo, "foobar", 0)
+	rec.AddAttrs(
+		slog.String("secret", "hunter2"),
+		slog.String("drop", "gone"),
+		slog.Group("g", slog.String("secret", "inner")),
+	)
+	AssertNoError(t, h.Handle(context.Background(), rec))
+
+	expected := fmt.Sprintf("%s INF [foobar] secret=REDACTED g.secret=REDACTED\r\n", now.Format(time.DateTime))
+	AssertEqual(t, expected, buf.String())
+}
+
+func TestHandler_ConcurrentWrites(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := NewHandler(&buf, &HandlerOptions{NoColor: true})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			h2 := h.WithAttrs([]slog.Attr{slog.Int("n", n)})
+			rec := slog.NewRecord(time.Now(), slog.LevelInfo, "concurrent", 0)
+			AssertNoError(t, h2.Handle(context.Background(), rec))
+		}(i)
+	}
+	wg.Wait()
+
+	lines := bytes.Count(buf.Bytes(), []byte("\r\n"))
+	AssertEqual(t, 50, lines)
+}
+
+func TestHandler_FormatJSON_Groups(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := NewHandler(&buf, &HandlerOptions{Format: FormatJSON})
+	now := time.Now()
+
+	h2 := h.WithGroup("s").WithAttrs([]slog.Attr{slog.Int("a", 1)})
+	rec := slog.NewRecord(now, slog.LevelInfo, "foobar", 0)
+	rec.AddAttrs(slog.Int("b", 2))
+	AssertNoError(t, h2.Handle(context.Background(), rec))
+	expected := fmt.Sprintf(`{"time":"%s","level":"INFO","msg":"foobar","s":{"a":1,"b":2}}`+"\n", now.Format(time.DateTime))
+	AssertEqual(t, expected, buf.String())
+	buf.Reset()
+
+	// A group with no attributes in the end never appears in the output.
+	h3 := h.WithGroup("empty")
+	rec2 := slog.NewRecord(now, slog.LevelInfo, "foobar", 0)
+	AssertNoError(t, h3.Handle(context.Background(), rec2))
+	expected = fmt.Sprintf(`{"time":"%s","level":"INFO","msg":"foobar"}`+"\n", now.Format(time.DateTime))
+	AssertEqual(t, expected, buf.String())
+	buf.Reset()
+
+	// An inline slog.Group nests as its own JSON object too.
+	rec3 := slog.NewRecord(now, slog.LevelInfo, "foobar", 0)
+	rec3.AddAttrs(slog.Group("g", slog.Int("x", 1)))
+	AssertNoError(t, h.Handle(context.Background(), rec3))
+	expected = fmt.Sprintf(`{"time":"%s","level":"INFO","msg":"foobar","g":{"x":1}}`+"\n", now.Format(time.DateTime))
+	AssertEqual(t, expected, buf.String())
+	buf.Reset()
+
+	// A group passed to WithAttrs that ends up with no attributes of its
+	// own (here, an empty nested slog.Group) never appears in the output
+	// either, just like WithGroup with no attrs at all.
+	h4 := h.WithGroup("g").WithAttrs([]slog.Attr{slog.Group("inner")})
+	rec4 := slog.NewRecord(now, slog.LevelInfo, "foobar", 0)
+	AssertNoError(t, h4.Handle(context.Background(), rec4))
+	expected = fmt.Sprintf(`{"time":"%s","level":"INFO","msg":"foobar"}`+"\n", now.Format(time.DateTime))
+	AssertEqual(t, expected, buf.String())
+	buf.Reset()
+
+	// An inline slog.Group entirely emptied by ReplaceAttr also never
+	// appears in the output, same as a group with no attributes to begin
+	// with.
+	h5 := NewHandler(&buf, &HandlerOptions{
+		Format: FormatJSON,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == "secret" {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	rec5 := slog.NewRecord(now, slog.LevelInfo, "foobar", 0)
+	rec5.AddAttrs(slog.Group("g", slog.String("secret", "x")))
+	AssertNoError(t, h5.Handle(context.Background(), rec5))
+	expected = fmt.Sprintf(`{"time":"%s","level":"INFO","msg":"foobar"}`+"\n", now.Format(time.DateTime))
+	AssertEqual(t, expected, buf.String())
+}
+
+func TestHandler_LevelDelta(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := NewHandler(&buf, &HandlerOptions{NoColor: true, Level: slog.LevelDebug - 8})
+	now := time.Now()
+
+	rec := slog.NewRecord(now, slog.Level(slog.LevelInfo+2), "foobar", 0)
+	AssertNoError(t, h.Handle(context.Background(), rec))
+	AssertEqual(t, fmt.Sprintf("%s INF+2 foobar\r\n", now.Format(time.DateTime)), buf.String())
+	buf.Reset()
+
+	rec2 := slog.NewRecord(now, slog.Level(slog.LevelDebug-1), "foobar", 0)
+	AssertNoError(t, h.Handle(context.Background(), rec2))
+	AssertEqual(t, fmt.Sprintf("%s DBG-1 foobar\r\n", now.Format(time.DateTime)), buf.String())
+}
+
+func TestHandler_WithNamedLevel(t *testing.T) {
+	buf := bytes.Buffer{}
+	levelTrace := slog.LevelDebug - 4
+	theme := WithNamedLevel(NewDefaultTheme(), levelTrace, ansiBrightBlack, "TRC")
+	h := NewHandler(&buf, &HandlerOptions{NoColor: true, Level: levelTrace, Theme: theme})
+	now := time.Now()
+
+	rec := slog.NewRecord(now, levelTrace, "foobar", 0)
+	AssertNoError(t, h.Handle(context.Background(), rec))
+	AssertEqual(t, fmt.Sprintf("%s TRC foobar\r\n", now.Format(time.DateTime)), buf.String())
+}
+
+func TestHandler_ThemeIgnoredForJSON(t *testing.T) {
+	buf := bytes.Buffer{}
+	levelFatal := slog.LevelError + 4
+	theme := WithNamedLevel(NewDefaultTheme(), levelFatal, ansiBrightRed, "FTL")
+	h := NewHandler(&buf, &HandlerOptions{Format: FormatJSON, Theme: theme})
+	now := time.Now()
+
+	// Theme only affects FormatConsole: JSON always gets slog's own level
+	// string, never a custom theme label or color.
+	rec := slog.NewRecord(now, levelFatal, "boom", 0)
+	AssertNoError(t, h.Handle(context.Background(), rec))
+	expected := fmt.Sprintf(`{"time":"%s","level":"ERROR+4","msg":"boom"}`+"\n", now.Format(time.DateTime))
+	AssertEqual(t, expected, buf.String())
+}
+
+func TestHandler_ContextDepth(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := NewHandler(&buf, &HandlerOptions{NoColor: true, Indent: DefaultIndentation("  ")})
+	now := time.Now()
+
+	ctx := context.Background()
+	AssertNoError(t, h.Handle(ctx, slog.NewRecord(now, slog.LevelInfo, "outer", 0)))
+
+	Traced(ctx, func(ctx2 context.Context) {
+		AssertNoError(t, h.Handle(ctx2, slog.NewRecord(now, slog.LevelInfo, "inner", 0)))
+
+		Traced(ctx2, func(ctx3 context.Context) {
+			AssertNoError(t, h.Handle(ctx3, slog.NewRecord(now, slog.LevelInfo, "innermost", 0)))
+		})
+	})
+
+	AssertNoError(t, h.Handle(ctx, slog.NewRecord(now, slog.LevelInfo, "back to outer", 0)))
+
+	expected := fmt.Sprintf(
+		"%[1]s INF outer\r\n%[1]s INF \"  inner\"\r\n%[1]s INF \"    innermost\"\r\n%[1]s INF \"back to outer\"\r\n",
+		now.Format(time.DateTime),
+	)
+	AssertEqual(t, expected, buf.String())
+}
+
+func TestHandler_Vmodule(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := NewHandler(&buf, &HandlerOptions{
+		NoColor: true,
+		Level:   slog.LevelError,
+		Vmodule: "handler_test.go=debug",
+	})
+
+	// A debug record from this file matches the Vmodule rule, so it's
+	// logged even though it's below the global Level.
+	rec := recordAt(slog.LevelDebug, "foobar")
+	AssertNoError(t, h.Handle(context.Background(), rec))
+	if buf.Len() == 0 {
+		t.Fatal("expected record matching Vmodule rule to be logged")
+	}
+	buf.Reset()
+
+	// A record with no PC can't be matched against Vmodule, so it falls
+	// back to the global Level and is discarded.
+	rec2 := slog.NewRecord(time.Now(), slog.LevelDebug, "foobar", 0)
+	AssertNoError(t, h.Handle(context.Background(), rec2))
+	AssertEqual(t, "", buf.String())
+
+	// SetVmodule reconfigures the rules on an existing Handler.
+	h.SetVmodule("")
+	rec3 := recordAt(slog.LevelDebug, "foobar")
+	AssertNoError(t, h.Handle(context.Background(), rec3))
+	AssertEqual(t, "", buf.String())
+}
+
 func TestHandler_WithGroup(t *testing.T) {
 	buf := bytes.Buffer{}
 	h := NewHandler(&buf, &HandlerOptions{NoColor: true})
@@ -0,0 +1,119 @@
+package console
+
+import (
+	"log/slog"
+	"strconv"
+)
+
+// ansiReset clears any color/style set by a Theme color code.
+const ansiReset = "\x1b[0m"
+
+// ANSI color codes used by the default Theme.
+const (
+	ansiBrightBlack   = "\x1b[90m"
+	ansiBrightRed     = "\x1b[91m"
+	ansiBrightGreen   = "\x1b[92m"
+	ansiBrightYellow  = "\x1b[93m"
+	ansiBrightMagenta = "\x1b[95m"
+	ansiBrightWhite   = "\x1b[97m"
+)
+
+// Theme defines the ANSI color codes and level labels used when rendering
+// console output. Implementations are only consulted for the console format;
+// they are ignored when HandlerOptions.Format selects JSON or logfmt output.
+type Theme interface {
+	// Timestamp returns the ANSI color code used for the timestamp field.
+	Timestamp() string
+
+	// Message returns the ANSI color code used for the message field.
+	Message() string
+
+	// Source returns the ANSI color code used for the source field.
+	Source() string
+
+	// AttrKey returns the ANSI color code used for attribute keys.
+	AttrKey() string
+
+	// AttrValue returns the ANSI color code used for attribute values.
+	AttrValue() string
+
+	// Level returns the ANSI color code and short label used for level.
+	// A level that doesn't exactly match one of the four standard levels
+	// (e.g. a custom slog.Level(slog.LevelInfo+2)) is rendered using the
+	// color of the highest standard level at or below it (DBG for anything
+	// below slog.LevelDebug), with that level's label suffixed by the
+	// signed decimal delta, e.g. "INF+2" or "DBG-1". Use WithNamedLevel to
+	// register an exact label for a custom level instead, taking
+	// precedence over the delta form.
+	Level(level slog.Level) (color string, label string)
+}
+
+// defaultTheme is the Theme used when HandlerOptions.Theme is not set.
+type defaultTheme struct{}
+
+// NewDefaultTheme returns the default Theme implementation.
+func NewDefaultTheme() Theme {
+	return defaultTheme{}
+}
+
+func (defaultTheme) Timestamp() string { return ansiBrightBlack }
+func (defaultTheme) Message() string   { return ansiBrightWhite }
+func (defaultTheme) Source() string    { return ansiBrightBlack }
+func (defaultTheme) AttrKey() string   { return "" }
+func (defaultTheme) AttrValue() string { return "" }
+
+func (defaultTheme) Level(level slog.Level) (string, string) {
+	switch {
+	case level < slog.LevelInfo:
+		return ansiBrightMagenta, levelLabel("DBG", level-slog.LevelDebug)
+	case level < slog.LevelWarn:
+		return ansiBrightGreen, levelLabel("INF", level-slog.LevelInfo)
+	case level < slog.LevelError:
+		return ansiBrightYellow, levelLabel("WRN", level-slog.LevelWarn)
+	default:
+		return ansiBrightRed, levelLabel("ERR", level-slog.LevelError)
+	}
+}
+
+// levelLabel renders label on its own, or (tint-style) label suffixed with
+// delta as a signed decimal, e.g. "INF+2", when delta is non-zero. This is
+// how a custom slog.Level between the four standard levels is rendered
+// when no named label has been registered for its exact value.
+func levelLabel(label string, delta slog.Level) string {
+	if delta == 0 {
+		return label
+	}
+	sign := "+"
+	if delta < 0 {
+		sign = "-"
+		delta = -delta
+	}
+	return label + sign + strconv.Itoa(int(delta))
+}
+
+// namedLevelTheme wraps a Theme, giving one exact slog.Level a fixed
+// color and label that takes precedence over Theme's usual delta-from-
+// standard-level rendering; any other level is rendered by the wrapped Theme.
+type namedLevelTheme struct {
+	Theme
+	level slog.Level
+	color string
+	label string
+}
+
+func (t namedLevelTheme) Level(level slog.Level) (string, string) {
+	if level == t.level {
+		return t.color, t.label
+	}
+	return t.Theme.Level(level)
+}
+
+// WithNamedLevel returns a Theme wrapping base that renders level using
+// color and label exactly, instead of the delta form base would otherwise
+// produce for it. Chain calls to register more than one named level, e.g.
+//
+//	theme := WithNamedLevel(NewDefaultTheme(), slog.LevelDebug-4, ansiBrightBlack, "TRC")
+//	theme = WithNamedLevel(theme, slog.LevelError+4, ansiBrightRed, "FTL")
+func WithNamedLevel(base Theme, level slog.Level, color, label string) Theme {
+	return namedLevelTheme{Theme: base, level: level, color: color, label: label}
+}
@@ -0,0 +1,153 @@
+package console
+
+import (
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// vmoduleRule is one compiled "pattern=level" entry from a Vmodule string.
+// Exactly one of dir and file is set: dir for a "pkg/*" pattern, matching
+// any file in the pkg directory; file for an exact "pkg/file.go" pattern.
+type vmoduleRule struct {
+	dir   string
+	file  string
+	level slog.Level
+}
+
+// match reports whether file (a slash-separated path, made relative to the
+// working directory when possible) satisfies r.
+func (r vmoduleRule) match(file string) bool {
+	if r.file != "" {
+		return file == r.file || filepath.Base(file) == r.file
+	}
+	dir := filepath.ToSlash(filepath.Dir(file))
+	return dir == r.dir || strings.HasSuffix(dir, "/"+r.dir)
+}
+
+// parseVmodule parses a Vmodule string such as
+// "server/*=debug,db/query.go=trace" into the list of rules it describes,
+// in the order given; the first rule matching a record's source file wins.
+// Malformed entries (no "=", unrecognized level name) are skipped.
+func parseVmodule(v string) []vmoduleRule {
+	if v == "" {
+		return nil
+	}
+	var rules []vmoduleRule
+	for _, entry := range strings.Split(v, ",") {
+		pattern, levelName, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		level, ok := parseLevelName(strings.TrimSpace(levelName))
+		if !ok {
+			continue
+		}
+		pattern = strings.TrimSpace(pattern)
+		rule := vmoduleRule{level: level}
+		if dir, ok := strings.CutSuffix(pattern, "/*"); ok {
+			rule.dir = dir
+		} else {
+			rule.file = pattern
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// parseLevelName parses a level name used in a Vmodule entry: "trace",
+// "debug", "info", "warn" (or "warning"), or "error", case-insensitive.
+// slog has no Trace level, so it's represented as four steps below
+// slog.LevelDebug, consistent with the step size between the other levels.
+func parseLevelName(name string) (slog.Level, bool) {
+	switch strings.ToLower(name) {
+	case "trace":
+		return slog.LevelDebug - 4, true
+	case "debug":
+		return slog.LevelDebug, true
+	case "info":
+		return slog.LevelInfo, true
+	case "warn", "warning":
+		return slog.LevelWarn, true
+	case "error":
+		return slog.LevelError, true
+	default:
+		return 0, false
+	}
+}
+
+// vmoduleState holds Vmodule's compiled rules plus a cache of PC->source
+// file lookups, shared by a root Handler and every Handler derived from it
+// (via WithAttrs or WithGroup), so that SetVmodule affects all of them and
+// the symbolization cache is never duplicated.
+type vmoduleState struct {
+	mu    sync.RWMutex
+	rules []vmoduleRule
+	files sync.Map // uintptr (PC) -> string (source file, relative to cwd when possible)
+}
+
+func newVmoduleState(v string) *vmoduleState {
+	return &vmoduleState{rules: parseVmodule(v)}
+}
+
+// set replaces the compiled rules, as SetVmodule does.
+func (s *vmoduleState) set(v string) {
+	rules := parseVmodule(v)
+	s.mu.Lock()
+	s.rules = rules
+	s.mu.Unlock()
+}
+
+// minLevel returns the lowest level any rule could select, or fallback if
+// there are no rules. Handler.Enabled uses this for a cheap, PC-agnostic
+// pre-check: a record can't possibly be logged if it's below every level
+// Vmodule or opts.Level could select, but being at or above that minimum
+// doesn't yet mean it matches a rule for its specific file - that's only
+// known once Handle has the record's PC.
+func (s *vmoduleState) minLevel(fallback slog.Level) slog.Level {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	min := fallback
+	for _, r := range s.rules {
+		if r.level < min {
+			min = r.level
+		}
+	}
+	return min
+}
+
+// effectiveLevel resolves the minimum level a record logged from pc should
+// be logged at: the level of the first rule whose pattern matches pc's
+// source file, or fallback if no rule matches. The PC->file resolution
+// (the expensive part, since it symbolizes a program counter) is cached,
+// since the same call sites log repeatedly.
+func (s *vmoduleState) effectiveLevel(pc uintptr, fallback slog.Level) slog.Level {
+	s.mu.RLock()
+	rules := s.rules
+	s.mu.RUnlock()
+	if len(rules) == 0 {
+		return fallback
+	}
+	file := s.sourceFile(pc)
+	for _, r := range rules {
+		if r.match(file) {
+			return r.level
+		}
+	}
+	return fallback
+}
+
+func (s *vmoduleState) sourceFile(pc uintptr) string {
+	if cached, ok := s.files.Load(pc); ok {
+		return cached.(string)
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	file := filepath.ToSlash(frame.File)
+	if rel, err := filepath.Rel(cwd, frame.File); err == nil {
+		file = filepath.ToSlash(rel)
+	}
+	s.files.Store(pc, file)
+	return file
+}